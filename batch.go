@@ -0,0 +1,113 @@
+package link
+
+import "net"
+
+// PacketBatchReader is an optional extension to PacketReader. A reader
+// that can pull several frames off the wire in one syscall (e.g. an
+// epoll or io_uring bound reader) implements it; readBatch detects it
+// with a type assertion and prefers it when available, falling back to
+// ReadPacket so scalar readers keep working unchanged.
+type PacketBatchReader interface {
+	ReadPackets(conn net.Conn, bufs []InBuffer) (int, error)
+}
+
+// readBatch reads one round of packets with reader into bufs, preferring
+// reader's PacketBatchReader.ReadPackets when it implements the
+// interface and falling back to a single ReadPacket call otherwise. It
+// returns the number of buffers in bufs that were filled. Nothing in
+// this package calls it outside the tests; there is no read loop here to
+// call it from.
+func readBatch(conn net.Conn, reader PacketReader, bufs []InBuffer) (int, error) {
+	if br, ok := reader.(PacketBatchReader); ok {
+		return br.ReadPackets(conn, bufs)
+	}
+	if err := reader.ReadPacket(conn, bufs[0]); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// batchUse marks every buffer in bufs as part of a broadcast batch and
+// bumps its refCount, so a partial write to one recipient can't free a
+// buffer that's still queued for another.
+func batchUse(bufs []*OutBuffer) {
+	for _, buf := range bufs {
+		buf.isBroadcast = true
+		buf.broadcastUse()
+	}
+}
+
+// batchFree releases every buffer in bufs, returning each to the pool
+// once its refCount reaches zero.
+func batchFree(bufs []*OutBuffer) {
+	for _, buf := range bufs {
+		buf.broadcastFree()
+	}
+}
+
+// netBuffers flattens bufs' Data into a net.Buffers so a batch send can
+// go out as a single vectored writev syscall instead of one conn.Write
+// per packet.
+func netBuffers(bufs []*OutBuffer) net.Buffers {
+	nb := make(net.Buffers, len(bufs))
+	for i, buf := range bufs {
+		nb[i] = buf.Data
+	}
+	return nb
+}
+
+// SendBatch writes bufs to conn as a single vectored write (net.Buffers
+// uses writev on Linux) instead of one conn.Write per packet. Useful for
+// fan-out workloads that already have several encoded packets queued
+// for the same connection.
+//
+// This takes conn directly rather than a *Session: this tree doesn't
+// carry session.go, so there's no Session to hang the method off of.
+//
+// TODO(session.go): the originally requested Session.SendBatch is
+// outstanding, not delivered by this. Once session.go lands it should
+// be a thin wrapper calling SendBatch(session.Conn(), bufs).
+func SendBatch(conn net.Conn, bufs []*OutBuffer) error {
+	batchUse(bufs)
+	defer batchFree(bufs)
+
+	nb := netBuffers(bufs)
+	_, err := nb.WriteTo(conn)
+	return err
+}
+
+// Broadcast writes bufs to every connection in conns. Each recipient
+// still gets its own vectored write, since writev can't span multiple
+// sockets, but the batch's refCount is bumped once per recipient before
+// any write starts and dropped once each write finishes, so bufs are
+// only freed back to the pool once every recipient is done with them. A
+// recipient whose write fails (e.g. a dead connection) is closed.
+//
+// This takes conns directly rather than a *Server: this tree doesn't
+// carry server.go, so there's no Server/session registry to range over
+// or filter by.
+//
+// TODO(server.go): the originally requested
+// Server.Broadcast(bufs, filter func(*Session) bool) is outstanding,
+// not delivered by this. Once server.go lands it should collect the
+// filtered sessions' conns and call this.
+func Broadcast(conns []net.Conn, bufs []*OutBuffer) {
+	// Take every recipient's reference up front, so a write that finishes
+	// early can't drop refCount to zero while later recipients are still
+	// being started.
+	for range conns {
+		batchUse(bufs)
+	}
+	for _, conn := range conns {
+		go func(conn net.Conn) {
+			defer batchFree(bufs)
+			// Each recipient gets its own net.Buffers: WriteTo consumes
+			// its receiver as it writes, so sharing one across goroutines
+			// would race.
+			nb := netBuffers(bufs)
+			if _, err := nb.WriteTo(conn); err != nil {
+				conn.Close()
+			}
+		}(conn)
+	}
+}
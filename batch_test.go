@@ -0,0 +1,175 @@
+package link
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeReader is a PacketReader whose ReadPacket succeeds without
+// touching the network, for testing readBatch's scalar fallback. It gets
+// buffer by value, so the data it assigns never reaches the caller.
+type fakeReader struct {
+	data []byte
+}
+
+func (r fakeReader) ReadPacket(conn net.Conn, buffer InBuffer) error {
+	buffer.Data = r.data
+	return nil
+}
+
+// fakeBatchReader additionally implements PacketBatchReader, so
+// readBatch should prefer ReadPackets over ReadPacket.
+type fakeBatchReader struct {
+	fakeReader
+	n   int
+	err error
+}
+
+func (r fakeBatchReader) ReadPackets(conn net.Conn, bufs []InBuffer) (int, error) {
+	return r.n, r.err
+}
+
+func TestReadBatchFallsBackToReadPacket(t *testing.T) {
+	bufs := make([]InBuffer, 1)
+	n, err := readBatch(nil, fakeReader{data: []byte("x")}, bufs)
+	if err != nil || n != 1 {
+		t.Fatalf("readBatch = %d, %v, want 1, nil", n, err)
+	}
+}
+
+func TestReadBatchPrefersPacketBatchReader(t *testing.T) {
+	bufs := make([]InBuffer, 4)
+	n, err := readBatch(nil, fakeBatchReader{n: 3}, bufs)
+	if err != nil || n != 3 {
+		t.Fatalf("readBatch = %d, %v, want 3, nil", n, err)
+	}
+}
+
+func TestReadBatchPropagatesError(t *testing.T) {
+	boom := errors.New("boom")
+	bufs := make([]InBuffer, 1)
+	if _, err := readBatch(nil, fakeBatchReader{err: boom}, bufs); err != boom {
+		t.Fatalf("readBatch err = %v, want %v", err, boom)
+	}
+}
+
+func TestBatchUseFreeReleasesOnLastRef(t *testing.T) {
+	bufs := []*OutBuffer{NewOutBuffer(), NewOutBuffer()}
+
+	// Two recipients: bumped once per recipient, so the batch must
+	// survive one free and only return to the pool after the second.
+	batchUse(bufs)
+	batchUse(bufs)
+
+	batchFree(bufs)
+	for _, b := range bufs {
+		if b.isFreed {
+			t.Fatal("batchFree released buffers before every recipient was done")
+		}
+	}
+
+	batchFree(bufs)
+	for _, b := range bufs {
+		if !b.isFreed {
+			t.Fatal("batchFree did not release buffers once every recipient was done")
+		}
+	}
+}
+
+func TestNetBuffers(t *testing.T) {
+	a, b := NewOutBuffer(), NewOutBuffer()
+	a.Append([]byte("hello")...)
+	b.Append([]byte("world")...)
+
+	nb := netBuffers([]*OutBuffer{a, b})
+	if len(nb) != 2 || string(nb[0]) != "hello" || string(nb[1]) != "world" {
+		t.Fatalf("netBuffers = %v, want [hello world]", nb)
+	}
+}
+
+func TestSendBatchWritesAllBuffers(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	bufs := []*OutBuffer{NewOutBuffer(), NewOutBuffer()}
+	bufs[0].Append([]byte("foo")...)
+	bufs[1].Append([]byte("bar")...)
+
+	done := make(chan error, 1)
+	go func() { done <- SendBatch(client, bufs) }()
+
+	got := make([]byte, 6)
+	if _, err := readFull(server, got); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("SendBatch: %v", err)
+	}
+	if !bytes.Equal(got, []byte("foobar")) {
+		t.Fatalf("got %q, want %q", got, "foobar")
+	}
+	if !bufs[0].isFreed || !bufs[1].isFreed {
+		t.Fatal("SendBatch did not free its buffers back to the pool")
+	}
+}
+
+// fakeConn is a net.Conn stand-in whose Write always fails, so
+// Broadcast's close-on-error path can be exercised without a live
+// socket.
+type fakeConn struct {
+	net.Conn
+	closed bool
+}
+
+func (c *fakeConn) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func (c *fakeConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestBroadcastClosesConnOnWriteError(t *testing.T) {
+	bufs := []*OutBuffer{NewOutBuffer()}
+	bufs[0].Append([]byte("hi")...)
+
+	conn := &fakeConn{}
+	Broadcast([]net.Conn{conn}, bufs)
+
+	// Broadcast writes to each recipient in its own goroutine; wait for
+	// the buffer to come back to the pool as a proxy for "done".
+	waitForFree(t, bufs[0])
+
+	if !conn.closed {
+		t.Fatal("Broadcast did not close a connection whose write failed")
+	}
+}
+
+func readFull(conn net.Conn, buf []byte) (int, error) {
+	total := 0
+	for total < len(buf) {
+		n, err := conn.Read(buf[total:])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func waitForFree(t *testing.T, buf *OutBuffer) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if buf.isFreed {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("buffer was never freed")
+}
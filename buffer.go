@@ -2,15 +2,77 @@ package link
 
 import (
 	"encoding/binary"
+	"fmt"
 	"github.com/catinred2/sync"
 	"io"
 	"math"
+	"math/bits"
 	"sync/atomic"
 	"unicode/utf8"
 )
 
+// Number of size classes kept in the pool, one per power of two from
+// 1<<0 (1 B) through 1<<maxSizeClass (64 KiB).
+const numSizeClasses = 17
+const maxSizeClass = numSizeClasses - 1
+
 var globalPool = newBufferPool()
 
+// BufferPool lets callers substitute the allocator backing InBuffer and
+// OutBuffer, e.g. for tests, benchmarks, or a dedicated pool that keeps
+// a high-QPS session's hit rate isolated from noisy neighbors.
+type BufferPool interface {
+	GetInBuffer() *InBuffer
+	PutInBuffer(*InBuffer)
+	GetOutBuffer() *OutBuffer
+	PutOutBuffer(*OutBuffer)
+}
+
+var defaultPool BufferPool = globalPool
+
+// SetBufferPool replaces the package-level BufferPool used by
+// NewInBuffer, NewOutBuffer, (*InBuffer).Free and (*OutBuffer).Free, and
+// returns the previous one.
+//
+// TODO(session.go): this only swaps the process-wide default. The
+// originally requested per-session opt-in (Session.SetBufferPool, so a
+// single high-QPS session can use a dedicated pool without affecting
+// its neighbors) still needs session.go before it can be wired up;
+// track it as outstanding rather than covered by this package.
+func SetBufferPool(pool BufferPool) BufferPool {
+	old := defaultPool
+	defaultPool = pool
+	return old
+}
+
+// NopBufferPool is a BufferPool that never retains buffers: every Get
+// allocates fresh and every Put only marks the buffer freed, so a double
+// free still panics. Useful for diagnostic
+// builds or benchmarks that want to measure without pooling effects.
+type NopBufferPool struct{}
+
+func (pool NopBufferPool) GetInBuffer() *InBuffer {
+	return &InBuffer{Data: make([]byte, 0, globalPool.bufferInitSize), ByteOrder: binary.BigEndian, pool: pool}
+}
+
+func (NopBufferPool) PutInBuffer(in *InBuffer) {
+	if in.isFreed {
+		panic("link.InBuffer: double free")
+	}
+	in.isFreed = true
+}
+
+func (pool NopBufferPool) GetOutBuffer() *OutBuffer {
+	return &OutBuffer{Data: make([]byte, 0, globalPool.bufferInitSize), ByteOrder: binary.BigEndian, pool: pool}
+}
+
+func (NopBufferPool) PutOutBuffer(out *OutBuffer) {
+	if out.isFreed {
+		panic("link.OutBuffer: double free")
+	}
+	out.isFreed = true
+}
+
 // Get/Set initialization capacity for new buffer.
 func PoolNewDataSize(size int) int {
 	if size == 0 {
@@ -39,6 +101,13 @@ type PoolState struct {
 	DataHitRate float64 // Hit rate of buffer data.
 	FreeRate    float64 // Buffer free rate.
 	DropRate    float64 // Drop rate of large buffer.
+
+	// ClassHitRate is the buffer data hit rate broken down by size class,
+	// indexed by bits.Len(cap)-1, i.e. ClassHitRate[i] covers buffers of
+	// capacity 1<<i. Useful for spotting which packet sizes are causing
+	// fragmentation. Allocations larger than 1<<maxSizeClass are not
+	// counted in any class.
+	ClassHitRate [numSizeClasses]float64
 }
 
 // Get buffer pool hit rate
@@ -55,13 +124,21 @@ func GetPoolState() PoolState {
 	freeCount := float64(atomic.LoadUint64(&globalPool.freeCount))
 	dropCount := float64(atomic.LoadUint64(&globalPool.dropCount))
 
-	return PoolState{
+	state := PoolState{
 		InHitRate:   (getIn - newIn) / getIn,
 		OutHitRate:  (getOut - newOut) / getOut,
 		DataHitRate: (getData - newData) / getData,
 		FreeRate:    freeCount / (getIn + getOut),
 		DropRate:    dropCount / (getIn + getOut),
 	}
+
+	for i := 0; i < numSizeClasses; i++ {
+		classGet := float64(atomic.LoadUint64(&globalPool.classGet[i]))
+		classNew := float64(atomic.LoadUint64(&globalPool.classNew[i]))
+		state.ClassHitRate[i] = (classGet - classNew) / classGet
+	}
+
+	return state
 }
 
 type bufferPool struct {
@@ -75,10 +152,13 @@ type bufferPool struct {
 	getOut uint64
 	newOut uint64
 
-	// []byte
-	data    sync.Pool
-	getData uint64
-	newData uint64
+	// []byte, size-classed by power of two capacity: buffers[i] holds
+	// buffers of capacity 1<<i, covering 1 B through 64 KiB.
+	buffers  [numSizeClasses]sync.Pool
+	getData  uint64
+	newData  uint64
+	classGet [numSizeClasses]uint64
+	classNew [numSizeClasses]uint64
 
 	freeCount uint64
 	dropCount uint64
@@ -100,10 +180,9 @@ func newBufferPool() *bufferPool {
 		return new(OutBuffer)
 	}
 
-	pool.data.New = func() interface{} {
-		atomic.AddUint64(&pool.newData, 1)
-		return make([]byte, 0, pool.bufferInitSize)
-	}
+	// buffers[i].New is left nil on purpose: allocData checks for a miss
+	// itself so it can size the fresh slice exactly and keep per-class
+	// hit counters accurate.
 
 	pool.bufferInitSize = 4096
 	pool.bufferMaxSize = 102400
@@ -111,22 +190,76 @@ func newBufferPool() *bufferPool {
 	return pool
 }
 
+// sizeClass returns the size class index i such that 1<<i is the
+// smallest power of two >= size. Sizes above 1<<maxSizeClass are
+// clamped to maxSizeClass.
+func sizeClass(size int) int {
+	if size <= 1 {
+		return 0
+	}
+	class := bits.Len(uint(size - 1))
+	if class > maxSizeClass {
+		class = maxSizeClass
+	}
+	return class
+}
+
+// allocData returns a []byte of length size from the size-classed
+// pool, bounding internal fragmentation to at most 50%. Sizes larger
+// than 1<<maxSizeClass fall back to a plain allocation.
+func (pool *bufferPool) allocData(size int) []byte {
+	atomic.AddUint64(&pool.getData, 1)
+
+	class := sizeClass(size)
+	if size > 1<<uint(maxSizeClass) {
+		atomic.AddUint64(&pool.newData, 1)
+		return make([]byte, size)
+	}
+
+	atomic.AddUint64(&pool.classGet[class], 1)
+
+	if v := pool.buffers[class].Get(); v != nil {
+		return v.([]byte)[:size]
+	}
+
+	atomic.AddUint64(&pool.newData, 1)
+	atomic.AddUint64(&pool.classNew[class], 1)
+	return make([]byte, size, 1<<uint(class))
+}
+
+// putData returns buf to the size-classed pool. Buffers whose capacity
+// isn't exactly a pooled power of two are silently dropped so a
+// zeroed or mis-sized buffer can never re-enter the wrong size class.
+func (pool *bufferPool) putData(buf []byte) {
+	c := cap(buf)
+	if c == 0 || c&(c-1) != 0 {
+		return
+	}
+	class := bits.Len(uint(c)) - 1
+	if class > maxSizeClass {
+		return
+	}
+	pool.buffers[class].Put(buf[:0])
+}
+
 func (pool *bufferPool) GetInBuffer() *InBuffer {
 	atomic.AddUint64(&pool.getIn, 1)
-	atomic.AddUint64(&pool.getData, 1)
 
 	in := pool.in.Get().(*InBuffer)
-	in.Data = pool.data.Get().([]byte)
+	in.Data = pool.allocData(pool.bufferInitSize)
+	in.ByteOrder = binary.BigEndian
+	in.pool = pool
 	in.isFreed = false
 	return in
 }
 
 func (pool *bufferPool) GetOutBuffer() *OutBuffer {
 	atomic.AddUint64(&pool.getOut, 1)
-	atomic.AddUint64(&pool.getData, 1)
 
 	out := pool.out.Get().(*OutBuffer)
-	out.Data = pool.data.Get().([]byte)
+	out.Data = pool.allocData(pool.bufferInitSize)[:0]
+	out.ByteOrder = binary.BigEndian
+	out.pool = pool
 	out.isFreed = false
 	out.isBroadcast = false
 	out.refCount = 0
@@ -140,7 +273,7 @@ func (pool *bufferPool) PutInBuffer(in *InBuffer) {
 		return
 	}
 
-	pool.data.Put(in.Data[0:0])
+	pool.putData(in.Data)
 	in.Data = nil
 	in.ReadPos = 0
 	in.isFreed = true
@@ -154,7 +287,7 @@ func (pool *bufferPool) PutOutBuffer(out *OutBuffer) {
 		return
 	}
 
-	pool.data.Put(out.Data[0:0])
+	pool.putData(out.Data)
 	out.Data = nil
 	out.isFreed = true
 	pool.out.Put(out)
@@ -162,22 +295,30 @@ func (pool *bufferPool) PutOutBuffer(out *OutBuffer) {
 
 // Incomming message buffer.
 type InBuffer struct {
-	Data    []byte // Buffer data.
-	ReadPos int    // Read position.
-	isFreed bool
+	Data      []byte           // Buffer data.
+	ReadPos   int              // Read position.
+	ByteOrder binary.ByteOrder // Byte order used by Decode. Defaults to BigEndian.
+	pool      BufferPool       // Pool this buffer was obtained from; used by Prepare to grow.
+	isFreed   bool
 }
 
 // Create a new incomming message buffer.
 func NewInBuffer() *InBuffer {
-	return globalPool.GetInBuffer()
+	return defaultPool.GetInBuffer()
 }
 
 // Return the buffer to buffer pool.
+//
+// It returns to in.pool, the pool captured when the buffer was obtained,
+// not whatever pool is current now. SetBufferPool can swap the current
+// pool at any time; routing Free through the global would silently move
+// a buffer into a pool it never came from, defeating the per-pool
+// isolation SetBufferPool exists to provide.
 func (in *InBuffer) Free() {
 	if in.isFreed {
 		panic("link.InBuffer: double free")
 	}
-	globalPool.PutInBuffer(in)
+	in.pool.PutInBuffer(in)
 }
 
 // Prepare buffer for next message.
@@ -185,14 +326,30 @@ func (in *InBuffer) Free() {
 // Dont' use it in application logic.
 func (in *InBuffer) Prepare(size int) {
 	if cap(in.Data) < size {
-		in.Data = make([]byte, size)
+		if pool, ok := in.pool.(*bufferPool); ok {
+			pool.putData(in.Data)
+			in.Data = pool.allocData(size)
+		} else {
+			in.Data = make([]byte, size)
+		}
 	} else {
 		in.Data = in.Data[0:size]
 	}
 }
 
 // Slice some bytes from buffer.
+//
+// n is checked against the remaining *length*, not capacity: a
+// pool-backed buffer's cap(Data) commonly exceeds len(Data) (size
+// classes round capacity up to the next power of two), and Go's
+// two-index slice bound is cap, not len. Without this check, a read
+// past the real data wouldn't panic or error at all - it would
+// silently return whatever a previous tenant of the pooled backing
+// array left behind.
 func (in *InBuffer) Slice(n int) []byte {
+	if n < 0 || n > len(in.Data)-in.ReadPos {
+		panic(fmt.Sprintf("link.InBuffer.Slice: %d exceeds remaining buffer", n))
+	}
 	r := in.Data[in.ReadPos : in.ReadPos+n]
 	in.ReadPos += n
 	return r
@@ -288,7 +445,9 @@ func (in *InBuffer) ReadFloat64BE() float64 {
 
 // Outgoing message buffer.
 type OutBuffer struct {
-	Data        []byte // Buffer data.
+	Data        []byte           // Buffer data.
+	ByteOrder   binary.ByteOrder // Byte order used by Encode. Defaults to BigEndian.
+	pool        BufferPool       // Pool this buffer was obtained from; used by Prepare to grow.
 	isFreed     bool
 	isBroadcast bool
 	refCount    int32
@@ -296,7 +455,7 @@ type OutBuffer struct {
 
 // Create a new outgoing message buffer.
 func NewOutBuffer() *OutBuffer {
-	return globalPool.GetOutBuffer()
+	return defaultPool.GetOutBuffer()
 }
 
 func (out *OutBuffer) broadcastUse() {
@@ -310,11 +469,14 @@ func (out *OutBuffer) broadcastFree() {
 }
 
 // Return the buffer to buffer pool.
+//
+// See InBuffer.Free for why this goes through out.pool rather than the
+// global default.
 func (out *OutBuffer) Free() {
 	if out.isFreed {
 		panic("link.OutBuffer: double free")
 	}
-	globalPool.PutOutBuffer(out)
+	out.pool.PutOutBuffer(out)
 }
 
 // Prepare for next message.
@@ -322,7 +484,12 @@ func (out *OutBuffer) Free() {
 // Don't use it in application logic.
 func (out *OutBuffer) Prepare(size int) {
 	if cap(out.Data) < size {
-		out.Data = make([]byte, 0, size)
+		if pool, ok := out.pool.(*bufferPool); ok {
+			pool.putData(out.Data)
+			out.Data = pool.allocData(size)[:0]
+		} else {
+			out.Data = make([]byte, 0, size)
+		}
 	} else {
 		out.Data = out.Data[0:0]
 	}
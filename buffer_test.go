@@ -0,0 +1,107 @@
+package link
+
+import "testing"
+
+func TestSizeClass(t *testing.T) {
+	cases := []struct {
+		size int
+		want int
+	}{
+		{0, 0},
+		{1, 0},
+		{2, 1},
+		{3, 2},
+		{4, 2},
+		{5, 3},
+		{1 << maxSizeClass, maxSizeClass},
+		{1<<maxSizeClass + 1, maxSizeClass},
+	}
+	for _, c := range cases {
+		if got := sizeClass(c.size); got != c.want {
+			t.Errorf("sizeClass(%d) = %d, want %d", c.size, got, c.want)
+		}
+	}
+}
+
+// Every pooled allocation must land in a class whose capacity is at
+// least the requested size but less than double it, bounding internal
+// fragmentation to 50%.
+func TestAllocDataFragmentationBound(t *testing.T) {
+	pool := newBufferPool()
+	for size := 1; size <= 1<<maxSizeClass; size *= 3 {
+		buf := pool.allocData(size)
+		if len(buf) != size {
+			t.Fatalf("allocData(%d) len = %d, want %d", size, len(buf), size)
+		}
+		if cap(buf) < size {
+			t.Fatalf("allocData(%d) cap = %d, smaller than requested size", size, cap(buf))
+		}
+		if cap(buf) > 2*size {
+			t.Fatalf("allocData(%d) cap = %d, exceeds 2x size (50%% fragmentation bound)", size, cap(buf))
+		}
+	}
+}
+
+func TestAllocDataOversizeFallsBackToPlainAlloc(t *testing.T) {
+	pool := newBufferPool()
+	size := 1<<maxSizeClass + 1
+	buf := pool.allocData(size)
+	if len(buf) != size || cap(buf) != size {
+		t.Fatalf("allocData(%d) = len %d cap %d, want exact len/cap", size, len(buf), cap(buf))
+	}
+}
+
+func TestPutDataRoundTripsThroughSizeClass(t *testing.T) {
+	pool := newBufferPool()
+	buf := pool.allocData(100)
+	class := sizeClass(100)
+	pool.putData(buf)
+
+	got := pool.allocData(100)
+	if cap(got) != 1<<uint(class) {
+		t.Fatalf("allocData(100) after putData cap = %d, want %d (did it reuse the pooled buffer?)", cap(got), 1<<uint(class))
+	}
+}
+
+// putData must refuse buffers whose capacity isn't exactly a pooled
+// power of two, so a mis-sized buffer can never sneak into the wrong
+// size class and get handed back out too large or too small.
+func TestPutDataRejectsNonPowerOfTwoCapacity(t *testing.T) {
+	pool := newBufferPool()
+	buf := make([]byte, 0, 100) // not a power of two
+	pool.putData(buf)
+
+	// Had it been accepted, a cap-100 buffer would sit in class 6
+	// (bits.Len(100)-1), the class that serves allocData(64).
+	got := pool.allocData(64)
+	if cap(got) == 100 {
+		t.Fatalf("putData accepted a non-power-of-two capacity buffer into the pool")
+	}
+}
+
+// Free must return a buffer to the pool it was obtained from, not to
+// whatever pool SetBufferPool has made current in the meantime. A
+// buffer born under one pool that got routed through the global default
+// on Free would defeat the isolation SetBufferPool exists to provide.
+func TestFreeReturnsToOriginPoolNotCurrentDefault(t *testing.T) {
+	poolA := newBufferPool()
+	poolB := newBufferPool()
+
+	prev := SetBufferPool(poolA)
+	defer SetBufferPool(prev)
+
+	in := NewInBuffer()
+	out := NewOutBuffer()
+
+	SetBufferPool(poolB)
+
+	in.Free()
+	out.Free()
+
+	if poolA.freeCount != 2 {
+		t.Fatalf("poolA.freeCount = %d, want 2 (origin pool should see both frees)", poolA.freeCount)
+	}
+	if poolB.freeCount != 0 {
+		t.Fatalf("poolB.freeCount = %d, want 0 (current default pool should see nothing)", poolB.freeCount)
+	}
+}
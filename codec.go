@@ -0,0 +1,303 @@
+package link
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// Struct tag used by Encode/Decode to customize the wire layout of a
+// field:
+//
+//	link:"-"          skip this field entirely
+//	link:"endian:le"  use little endian for this field only (default: be)
+//	link:"len:N"      use an N byte length prefix for string/[]byte/slice
+//	                  fields (default: 2 bytes)
+//	link:"fixed:N"    fixed size, null-padded string of N bytes, no
+//	                  length prefix
+const structTag = "link"
+
+type fieldTag struct {
+	skip      bool
+	byteOrder binary.ByteOrder
+	lenSize   int
+	fixed     int
+}
+
+func parseFieldTag(f reflect.StructField, def binary.ByteOrder) fieldTag {
+	tag := fieldTag{byteOrder: def, lenSize: 2}
+
+	raw, ok := f.Tag.Lookup(structTag)
+	if !ok {
+		return tag
+	}
+
+	for _, opt := range splitTag(raw) {
+		switch {
+		case opt == "-":
+			tag.skip = true
+		case opt == "endian:le":
+			tag.byteOrder = binary.LittleEndian
+		case opt == "endian:be":
+			tag.byteOrder = binary.BigEndian
+		case hasPrefix(opt, "len:"):
+			tag.lenSize = atoi(opt[len("len:"):])
+		case hasPrefix(opt, "fixed:"):
+			tag.fixed = atoi(opt[len("fixed:"):])
+		}
+	}
+
+	return tag
+}
+
+func splitTag(s string) []string {
+	var parts []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == ',' {
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func hasPrefix(s, prefix string) bool {
+	return len(s) >= len(prefix) && s[:len(prefix)] == prefix
+}
+
+func atoi(s string) int {
+	n := 0
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return n
+		}
+		n = n*10 + int(c-'0')
+	}
+	return n
+}
+
+// Encode writes v's fields, in declared order, onto the buffer using
+// out.ByteOrder. v must be a struct or a pointer to one. Field layout
+// can be customized with the `link` struct tag; see structTag.
+func (out *OutBuffer) Encode(v interface{}) {
+	val := reflect.ValueOf(v)
+	for val.Kind() == reflect.Ptr {
+		val = val.Elem()
+	}
+	if val.Kind() != reflect.Struct {
+		panic("link.OutBuffer.Encode: v must be a struct")
+	}
+	out.encodeStruct(val)
+}
+
+func (out *OutBuffer) encodeStruct(val reflect.Value) {
+	t := val.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := parseFieldTag(field, out.ByteOrder)
+		if tag.skip {
+			continue
+		}
+		out.encodeValue(val.Field(i), tag)
+	}
+}
+
+func (out *OutBuffer) encodeValue(val reflect.Value, tag fieldTag) {
+	switch val.Kind() {
+	case reflect.Uint8:
+		out.WriteUint8(uint8(val.Uint()))
+	case reflect.Uint16:
+		tag.byteOrder.PutUint16(out.grow(2), uint16(val.Uint()))
+	case reflect.Uint32:
+		tag.byteOrder.PutUint32(out.grow(4), uint32(val.Uint()))
+	case reflect.Uint64:
+		tag.byteOrder.PutUint64(out.grow(8), val.Uint())
+	case reflect.Int8:
+		out.WriteUint8(uint8(val.Int()))
+	case reflect.Int16:
+		tag.byteOrder.PutUint16(out.grow(2), uint16(val.Int()))
+	case reflect.Int32:
+		tag.byteOrder.PutUint32(out.grow(4), uint32(val.Int()))
+	case reflect.Int64:
+		tag.byteOrder.PutUint64(out.grow(8), uint64(val.Int()))
+	case reflect.Float32:
+		tag.byteOrder.PutUint32(out.grow(4), math.Float32bits(float32(val.Float())))
+	case reflect.Float64:
+		tag.byteOrder.PutUint64(out.grow(8), math.Float64bits(val.Float()))
+	case reflect.String:
+		out.encodeBytes([]byte(val.String()), tag)
+	case reflect.Array:
+		for i := 0; i < val.Len(); i++ {
+			out.encodeValue(val.Index(i), tag)
+		}
+	case reflect.Slice:
+		if val.Type().Elem().Kind() == reflect.Uint8 {
+			out.encodeBytes(val.Bytes(), tag)
+			return
+		}
+		out.writeLen(val.Len(), tag.lenSize)
+		for i := 0; i < val.Len(); i++ {
+			out.encodeValue(val.Index(i), tag)
+		}
+	case reflect.Struct:
+		out.encodeStruct(val)
+	default:
+		panic(fmt.Sprintf("link.OutBuffer.Encode: unsupported kind %s", val.Kind()))
+	}
+}
+
+func (out *OutBuffer) encodeBytes(b []byte, tag fieldTag) {
+	if tag.fixed > 0 {
+		if len(b) > tag.fixed {
+			panic(fmt.Sprintf("link.OutBuffer.Encode: value of length %d overflows link:\"fixed:%d\" field", len(b), tag.fixed))
+		}
+		padded := make([]byte, tag.fixed)
+		copy(padded, b)
+		out.Append(padded...)
+		return
+	}
+	out.writeLen(len(b), tag.lenSize)
+	out.Append(b...)
+}
+
+func (out *OutBuffer) writeLen(n int, size int) {
+	switch size {
+	case 1:
+		out.WriteUint8(uint8(n))
+	case 2:
+		out.WriteUint16BE(uint16(n))
+	case 4:
+		out.WriteUint32BE(uint32(n))
+	case 8:
+		out.WriteUint64BE(uint64(n))
+	default:
+		panic("link.OutBuffer.Encode: unsupported link:\"len\" prefix width")
+	}
+}
+
+// grow appends n zero bytes to Data and returns them for in-place
+// encoding, avoiding an extra allocation per field.
+func (out *OutBuffer) grow(n int) []byte {
+	out.Data = append(out.Data, make([]byte, n)...)
+	return out.Data[len(out.Data)-n:]
+}
+
+// Decode reads fields, in declared order, from the buffer into v using
+// in.ByteOrder. v must be a pointer to a struct. Field layout can be
+// customized with the `link` struct tag; see structTag.
+func (in *InBuffer) Decode(v interface{}) {
+	val := reflect.ValueOf(v)
+	if val.Kind() != reflect.Ptr || val.Elem().Kind() != reflect.Struct {
+		panic("link.InBuffer.Decode: v must be a pointer to a struct")
+	}
+	in.decodeStruct(val.Elem())
+}
+
+func (in *InBuffer) decodeStruct(val reflect.Value) {
+	t := val.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := parseFieldTag(field, in.ByteOrder)
+		if tag.skip {
+			continue
+		}
+		in.decodeValue(val.Field(i), tag)
+	}
+}
+
+func (in *InBuffer) decodeValue(val reflect.Value, tag fieldTag) {
+	switch val.Kind() {
+	case reflect.Uint8:
+		val.SetUint(uint64(in.ReadUint8()))
+	case reflect.Uint16:
+		val.SetUint(uint64(tag.byteOrder.Uint16(in.Slice(2))))
+	case reflect.Uint32:
+		val.SetUint(uint64(tag.byteOrder.Uint32(in.Slice(4))))
+	case reflect.Uint64:
+		val.SetUint(tag.byteOrder.Uint64(in.Slice(8)))
+	case reflect.Int8:
+		val.SetInt(int64(in.ReadUint8()))
+	case reflect.Int16:
+		val.SetInt(int64(tag.byteOrder.Uint16(in.Slice(2))))
+	case reflect.Int32:
+		val.SetInt(int64(tag.byteOrder.Uint32(in.Slice(4))))
+	case reflect.Int64:
+		val.SetInt(int64(tag.byteOrder.Uint64(in.Slice(8))))
+	case reflect.Float32:
+		val.SetFloat(float64(math.Float32frombits(tag.byteOrder.Uint32(in.Slice(4)))))
+	case reflect.Float64:
+		val.SetFloat(math.Float64frombits(tag.byteOrder.Uint64(in.Slice(8))))
+	case reflect.String:
+		val.SetString(string(in.decodeBytes(tag)))
+	case reflect.Array:
+		for i := 0; i < val.Len(); i++ {
+			in.decodeValue(val.Index(i), tag)
+		}
+	case reflect.Slice:
+		if val.Type().Elem().Kind() == reflect.Uint8 {
+			val.SetBytes(in.decodeBytes(tag))
+			return
+		}
+		n := in.checkedLen(tag.lenSize)
+		slice := reflect.MakeSlice(val.Type(), n, n)
+		for i := 0; i < n; i++ {
+			in.decodeValue(slice.Index(i), tag)
+		}
+		val.Set(slice)
+	case reflect.Struct:
+		in.decodeStruct(val)
+	default:
+		panic(fmt.Sprintf("link.InBuffer.Decode: unsupported kind %s", val.Kind()))
+	}
+}
+
+func (in *InBuffer) decodeBytes(tag fieldTag) []byte {
+	if tag.fixed > 0 {
+		raw := in.Slice(in.checkedFixed(tag.fixed))
+		n := 0
+		for n < len(raw) && raw[n] != 0 {
+			n++
+		}
+		return raw[:n]
+	}
+	n := in.checkedLen(tag.lenSize)
+	return in.Slice(n)
+}
+
+// checkedLen reads a length prefix and rejects one that can't possibly
+// fit in the remaining buffer, so a corrupt or malicious length prefix
+// can't drive an oversized allocation or an out-of-range Slice.
+func (in *InBuffer) checkedLen(size int) int {
+	n := in.readLen(size)
+	if n < 0 || n > len(in.Data)-in.ReadPos {
+		panic(fmt.Sprintf("link.InBuffer.Decode: length %d exceeds remaining buffer", n))
+	}
+	return n
+}
+
+// checkedFixed rejects a link:"fixed:N" width that doesn't fit in the
+// remaining buffer. Slice also panics on such a read; this check fails
+// first, with a message that names the fixed width.
+func (in *InBuffer) checkedFixed(n int) int {
+	if n > len(in.Data)-in.ReadPos {
+		panic(fmt.Sprintf("link.InBuffer.Decode: fixed width %d exceeds remaining buffer", n))
+	}
+	return n
+}
+
+func (in *InBuffer) readLen(size int) int {
+	switch size {
+	case 1:
+		return int(in.ReadUint8())
+	case 2:
+		return int(in.ReadUint16BE())
+	case 4:
+		return int(in.ReadUint32BE())
+	case 8:
+		return int(in.ReadUint64BE())
+	default:
+		panic("link.InBuffer.Decode: unsupported link:\"len\" prefix width")
+	}
+}
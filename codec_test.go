@@ -0,0 +1,130 @@
+package link
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+type codecInner struct {
+	X uint16
+}
+
+type codecSample struct {
+	A    uint8
+	B    uint32 `link:"endian:le"`
+	Name string
+	Tag  []byte `link:"fixed:4"`
+	Ids  []uint16
+	In   codecInner
+	Skip int `link:"-"`
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	in := codecSample{
+		A:    7,
+		B:    0x11223344,
+		Name: "hello",
+		Tag:  []byte{1, 2},
+		Ids:  []uint16{10, 20, 30},
+		In:   codecInner{X: 99},
+		Skip: 123,
+	}
+
+	out := NewOutBuffer()
+	out.Encode(&in)
+
+	buf := NewInBuffer()
+	buf.Data = out.Data
+
+	var got codecSample
+	buf.Decode(&got)
+
+	in.Skip = 0 // link:"-" fields never round-trip
+	if !reflect.DeepEqual(got, in) {
+		t.Fatalf("round trip mismatch: got %+v, want %+v", got, in)
+	}
+}
+
+func TestParseFieldTagDefaults(t *testing.T) {
+	type s struct {
+		Plain uint8
+	}
+	field, _ := reflect.TypeOf(s{}).FieldByName("Plain")
+	tag := parseFieldTag(field, binary.BigEndian)
+	if tag.skip || tag.fixed != 0 || tag.lenSize != 2 {
+		t.Fatalf("default tag = %+v, want skip=false fixed=0 lenSize=2", tag)
+	}
+}
+
+func TestParseFieldTagOptions(t *testing.T) {
+	type s struct {
+		F1 uint8 `link:"-"`
+		F2 uint8 `link:"endian:le"`
+		F3 uint8 `link:"len:4"`
+		F4 uint8 `link:"fixed:8"`
+	}
+	typ := reflect.TypeOf(s{})
+
+	f1, _ := typ.FieldByName("F1")
+	if !parseFieldTag(f1, binary.BigEndian).skip {
+		t.Fatal("link:\"-\" should set skip")
+	}
+
+	f2, _ := typ.FieldByName("F2")
+	if parseFieldTag(f2, binary.BigEndian).byteOrder != binary.LittleEndian {
+		t.Fatal("link:\"endian:le\" should select little endian")
+	}
+
+	f3, _ := typ.FieldByName("F3")
+	if parseFieldTag(f3, binary.BigEndian).lenSize != 4 {
+		t.Fatal("link:\"len:4\" should set lenSize to 4")
+	}
+
+	f4, _ := typ.FieldByName("F4")
+	if parseFieldTag(f4, binary.BigEndian).fixed != 8 {
+		t.Fatal("link:\"fixed:8\" should set fixed to 8")
+	}
+}
+
+// Decode must reject a slice length prefix that can't possibly fit in
+// the remaining buffer, instead of handing it straight to
+// reflect.MakeSlice where it could OOM the process.
+func TestDecodeRejectsOversizedSliceLength(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Decode did not panic on an oversized slice length prefix")
+		}
+	}()
+
+	buf := NewInBuffer()
+	buf.Data = []byte{0xFF, 0xFF} // claims a 65535-element slice, buffer has nothing else
+
+	var v struct {
+		Ids []uint16
+	}
+	buf.Decode(&v)
+}
+
+// Decode must reject a primitive read that runs past the buffer's real
+// length even when it still fits within the pooled backing array's
+// capacity, instead of silently handing back a previous tenant's
+// leftover bytes.
+func TestDecodeRejectsPrimitiveReadPastLength(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Decode did not panic on a primitive read past the buffer's length")
+		}
+	}()
+
+	buf := NewInBuffer()
+	buf.Data = make([]byte, 2, 64) // len 2, cap 64: plenty of room for a stale read
+	for i := range buf.Data[:cap(buf.Data)] {
+		buf.Data[:cap(buf.Data)][i] = 0xAA
+	}
+
+	var v struct {
+		X uint32
+	}
+	buf.Decode(&v)
+}
@@ -0,0 +1,250 @@
+package link
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/pierrec/lz4/v4"
+)
+
+// ErrTruncatedBody is returned by a Compressed PacketReader when a
+// packet is flagged compressedBody but is too short to even hold the
+// 4-byte original-length prefix.
+var ErrTruncatedBody = errors.New("link: truncated compressed packet body")
+
+// ErrDecompressedTooLarge is returned by a Compressed PacketReader when
+// a packet's declared original length exceeds the reader's maxsize (or
+// defaultMaxDecompressedSize, if maxsize is unset), so a forged length
+// prefix can't force an oversized allocation before a single byte is
+// decompressed.
+var ErrDecompressedTooLarge = errors.New("link: decompressed body exceeds max size")
+
+// defaultMaxDecompressedSize bounds origLen when the reader's
+// SimpleSettings.maxsize is unset (0, meaning "no limit" for framing
+// purposes elsewhere in the package).
+const defaultMaxDecompressedSize = 64 << 20 // 64 MiB
+
+// CompressAlgo is a pluggable codec for the Compressed protocol wrapper.
+// Compress appends the compressed form of src to dst and returns the
+// result. Decompress does the reverse; it must fully consume src.
+type CompressAlgo interface {
+	Compress(dst, src []byte) []byte
+	Decompress(dst, src []byte) ([]byte, error)
+}
+
+// Flags written as the first byte of every wrapped packet body, telling
+// the reader whether the rest of the body is compressed.
+const (
+	rawBody        byte = 0
+	compressedBody byte = 1
+)
+
+// noneAlgo is the identity CompressAlgo.
+type noneAlgo struct{}
+
+func (noneAlgo) Compress(dst, src []byte) []byte {
+	return append(dst, src...)
+}
+
+func (noneAlgo) Decompress(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+// NoneCompress never compresses: it is the identity CompressAlgo.
+// Payloads below a wrapper's minSize are written raw without going
+// through any algo, this one included.
+var NoneCompress CompressAlgo = noneAlgo{}
+
+// lz4Algo compresses with LZ4's block format, chosen for speed over
+// ratio since packets go through this path on every send.
+type lz4Algo struct{}
+
+func (lz4Algo) Compress(dst, src []byte) []byte {
+	bound := lz4.CompressBlockBound(len(src))
+	buf := globalPool.allocData(bound)
+	defer globalPool.putData(buf)
+
+	var c lz4.Compressor
+	n, err := c.CompressBlock(src, buf)
+	if err != nil || n == 0 {
+		return append(dst, src...)
+	}
+	return append(dst, buf[:n]...)
+}
+
+func (lz4Algo) Decompress(dst, src []byte) ([]byte, error) {
+	n, err := lz4.UncompressBlock(src, dst[:cap(dst)])
+	if err != nil {
+		return nil, err
+	}
+	return dst[:n], nil
+}
+
+// LZ4Compress compresses with LZ4 (fast mode).
+var LZ4Compress CompressAlgo = lz4Algo{}
+
+// Compressed wraps inner so that packet bodies are transparently
+// compressed with algo. Payloads smaller than minSize are written raw,
+// since the flag byte plus the codec's own overhead would make them
+// bigger, not smaller; the reader branches on the flag either way.
+func Compressed(inner Protocol, algo CompressAlgo, minSize int) Protocol {
+	return &compressedProtocol{inner: inner, algo: algo, minSize: minSize}
+}
+
+type compressedProtocol struct {
+	inner   Protocol
+	algo    CompressAlgo
+	minSize int
+}
+
+// Create a packet writer.
+func (p *compressedProtocol) NewWriter() PacketWriter {
+	return &compressedWriter{
+		inner:   p.inner.NewWriter(),
+		algo:    p.algo,
+		minSize: p.minSize,
+	}
+}
+
+// Create a packet reader.
+func (p *compressedProtocol) NewReader() PacketReader {
+	return &compressedReader{
+		inner: p.inner.NewReader(),
+		algo:  p.algo,
+	}
+}
+
+// The writer side of Compressed. It compresses OutBuffer.Data in place
+// before handing the packet to inner, so inner's framing (length
+// header, etc.) always sees the final, on-the-wire size.
+type compressedWriter struct {
+	SimpleSettings
+	inner   PacketWriter
+	algo    CompressAlgo
+	minSize int
+}
+
+func (w *compressedWriter) BeginPacket(size int, buffer OutBuffer) {
+	w.inner.BeginPacket(size, buffer)
+}
+
+func (w *compressedWriter) EndPacket(buffer OutBuffer) {
+	body := buffer.Data
+	if len(body) < w.minSize {
+		writeRawBody(&buffer, body)
+		w.inner.EndPacket(buffer)
+		return
+	}
+
+	// LZ4's own worst-case expansion, generous enough for any algo that
+	// doesn't pathologically blow up incompressible input.
+	bound := len(body) + len(body)/255 + 16
+	scratch := globalPool.allocData(bound)[:0]
+	scratch = w.algo.Compress(scratch, body)
+	defer globalPool.putData(scratch)
+
+	if len(scratch) >= len(body) {
+		// Didn't pay off: keep the raw body instead of shipping a
+		// "compressed" payload that's actually bigger.
+		writeRawBody(&buffer, body)
+	} else {
+		writeCompressedBody(&buffer, body, scratch)
+	}
+	w.inner.EndPacket(buffer)
+}
+
+// writeRawBody assembles the [rawBody flag][body] payload in a single
+// pool-backed scratch buffer and copies it into buffer. It takes buffer
+// by pointer since Prepare reassigns buffer.Data, and that reassignment
+// must be visible to the caller.
+func writeRawBody(buffer *OutBuffer, body []byte) {
+	out := globalPool.allocData(1 + len(body))[:0]
+	out = append(out, rawBody)
+	out = append(out, body...)
+	defer globalPool.putData(out)
+
+	buffer.Prepare(len(out))
+	buffer.Append(out...)
+}
+
+// writeCompressedBody assembles the [compressedBody flag][original
+// length][compressed bytes] payload in a single pool-backed scratch
+// buffer and copies it into buffer. See writeRawBody for why buffer is
+// a pointer.
+func writeCompressedBody(buffer *OutBuffer, body, compressed []byte) {
+	out := globalPool.allocData(5 + len(compressed))[:0]
+	out = append(out, compressedBody)
+
+	var origLen [4]byte
+	binary.BigEndian.PutUint32(origLen[:], uint32(len(body)))
+	out = append(out, origLen[:]...)
+	out = append(out, compressed...)
+	defer globalPool.putData(out)
+
+	buffer.Prepare(len(out))
+	buffer.Append(out...)
+}
+
+func (w *compressedWriter) WritePacket(conn net.Conn, buffer OutBuffer) error {
+	return w.inner.WritePacket(conn, buffer)
+}
+
+// The reader side of Compressed.
+type compressedReader struct {
+	SimpleSettings
+	inner PacketReader
+	algo  CompressAlgo
+}
+
+func (r *compressedReader) ReadPacket(conn net.Conn, buffer InBuffer) error {
+	if err := r.inner.ReadPacket(conn, buffer); err != nil {
+		return err
+	}
+	maxSize := r.maxsize
+	if maxSize <= 0 {
+		maxSize = defaultMaxDecompressedSize
+	}
+	return decodeBody(&buffer, buffer.Data, r.algo, maxSize)
+}
+
+// decodeBody parses the [flag][...] wire payload in body and replaces
+// buffer's contents with the decoded bytes. It takes buffer by pointer
+// for the same reason writeRawBody/writeCompressedBody do: Prepare
+// reassigns buffer.Data, and that reassignment needs to stick for the
+// rest of ReadPacket's own call. maxSize bounds the declared original
+// length of a compressed body, so a forged length prefix can't drive
+// an oversized allocation before anything is decompressed.
+func decodeBody(buffer *InBuffer, body []byte, algo CompressAlgo, maxSize int) error {
+	if len(body) == 0 {
+		return nil
+	}
+
+	flag, body := body[0], body[1:]
+	if flag == rawBody {
+		buffer.Prepare(len(body))
+		copy(buffer.Data, body)
+		return nil
+	}
+
+	if len(body) < 4 {
+		return ErrTruncatedBody
+	}
+
+	origLen := binary.BigEndian.Uint32(body[:4])
+	if origLen > uint32(maxSize) {
+		return ErrDecompressedTooLarge
+	}
+
+	plain := globalPool.allocData(int(origLen))
+	defer globalPool.putData(plain)
+
+	plain, err := algo.Decompress(plain[:0], body[4:])
+	if err != nil {
+		return err
+	}
+
+	buffer.Prepare(len(plain))
+	copy(buffer.Data, plain)
+	return nil
+}
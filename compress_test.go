@@ -0,0 +1,80 @@
+package link
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func encodeRawWire(body []byte) []byte {
+	return append([]byte{rawBody}, body...)
+}
+
+func encodeCompressedWire(algo CompressAlgo, body []byte) []byte {
+	compressed := algo.Compress(nil, body)
+	wire := []byte{compressedBody}
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(body)))
+	wire = append(wire, lenBuf[:]...)
+	wire = append(wire, compressed...)
+	return wire
+}
+
+func TestDecodeBodyRawRoundTrip(t *testing.T) {
+	body := []byte("hello, raw body")
+	buf := NewInBuffer()
+	if err := decodeBody(buf, encodeRawWire(body), NoneCompress, defaultMaxDecompressedSize); err != nil {
+		t.Fatalf("decodeBody: %v", err)
+	}
+	if string(buf.Data) != string(body) {
+		t.Fatalf("decodeBody raw = %q, want %q", buf.Data, body)
+	}
+}
+
+func TestDecodeBodyCompressedRoundTrip(t *testing.T) {
+	for _, algo := range []CompressAlgo{NoneCompress, LZ4Compress} {
+		body := []byte("hello, compressed world - a payload long enough to bother compressing")
+		buf := NewInBuffer()
+		if err := decodeBody(buf, encodeCompressedWire(algo, body), algo, defaultMaxDecompressedSize); err != nil {
+			t.Fatalf("decodeBody: %v", err)
+		}
+		if string(buf.Data) != string(body) {
+			t.Fatalf("decodeBody compressed = %q, want %q", buf.Data, body)
+		}
+	}
+}
+
+func TestDecodeBodyEmptyIsNoop(t *testing.T) {
+	buf := NewInBuffer()
+	buf.Data = []byte("untouched")
+	if err := decodeBody(buf, nil, NoneCompress, defaultMaxDecompressedSize); err != nil {
+		t.Fatalf("decodeBody: %v", err)
+	}
+	if string(buf.Data) != "untouched" {
+		t.Fatalf("decodeBody(nil) mutated buffer to %q", buf.Data)
+	}
+}
+
+// A packet flagged compressedBody but too short to hold the 4-byte
+// original-length prefix must return an error, not slice out of range.
+func TestDecodeBodyRejectsTruncatedCompressedBody(t *testing.T) {
+	buf := NewInBuffer()
+	for _, wire := range [][]byte{
+		{compressedBody},
+		{compressedBody, 0x01},
+		{compressedBody, 0x01, 0x02, 0x03},
+	} {
+		if err := decodeBody(buf, wire, NoneCompress, defaultMaxDecompressedSize); err != ErrTruncatedBody {
+			t.Fatalf("decodeBody(%v) = %v, want ErrTruncatedBody", wire, err)
+		}
+	}
+}
+
+// A forged origLen must be rejected before allocData ever sees it, so
+// a handful of tiny packets can't force multi-gigabyte allocations.
+func TestDecodeBodyRejectsOversizedOrigLen(t *testing.T) {
+	wire := []byte{compressedBody, 0x7F, 0xFF, 0xFF, 0xFF, 0, 0, 0, 0} // claims a ~2 GiB body
+	buf := NewInBuffer()
+	if err := decodeBody(buf, wire, NoneCompress, 1<<16); err != ErrDecompressedTooLarge {
+		t.Fatalf("decodeBody(oversized origLen) = %v, want ErrDecompressedTooLarge", err)
+	}
+}
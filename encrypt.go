@@ -0,0 +1,282 @@
+package link
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// ErrStaleKeyEpoch is returned by an encrypted PacketReader when a
+// packet's key epoch is unknown or has aged out of the grace window
+// after a rotation.
+var ErrStaleKeyEpoch = errors.New("link: stale key epoch")
+
+// ErrTruncatedCiphertext is returned by an encrypted PacketReader when
+// a packet is too short to hold the AEAD's nonce, let alone a sealed
+// body.
+var ErrTruncatedCiphertext = errors.New("link: truncated encrypted packet body")
+
+// How long a rotated-away epoch keeps decrypting inbound packets. The
+// peer needs this long to notice the new epoch and catch up; packets
+// older than this are assumed lost rather than in flight.
+const keyEpochGrace = 30 * time.Second
+
+// AEADAlgo constructs the cipher.AEAD used to seal/open packet bodies
+// for a given key.
+type AEADAlgo func(key []byte) (cipher.AEAD, error)
+
+// ChaCha20Poly1305 is the default AEADAlgo.
+func ChaCha20Poly1305(key []byte) (cipher.AEAD, error) {
+	return chacha20poly1305.New(key)
+}
+
+// AESGCM is an AEADAlgo alternative to ChaCha20Poly1305.
+func AESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// KeyProvider supplies the AEAD key a session encrypts and decrypts
+// with, and manages epoch rotation. One instance belongs to a single
+// session.
+type KeyProvider interface {
+	// CurrentKey returns the epoch and key new outbound packets should
+	// use.
+	CurrentKey() (epoch byte, key []byte)
+
+	// KeyForEpoch returns the key an inbound packet's epoch byte maps
+	// to. ok is false if the epoch is unknown, or if it was rotated
+	// away more than the grace window ago.
+	KeyForEpoch(epoch byte) (key []byte, ok bool)
+
+	// Rotate installs newKey as the current outbound key under a new
+	// epoch. The previous epoch keeps decrypting inbound packets until
+	// the grace window elapses, so writes can switch over before the
+	// peer has rotated too.
+	Rotate(newKey []byte)
+}
+
+// NewKeyProvider returns a KeyProvider seeded with key under epoch 0.
+func NewKeyProvider(key []byte) KeyProvider {
+	return &rotatingKeyProvider{
+		epoch: 0,
+		keys:  map[byte]rotatingKey{0: {key: key}},
+	}
+}
+
+type rotatingKey struct {
+	key      []byte
+	expireAt time.Time // zero means "current, never expires"
+}
+
+type rotatingKeyProvider struct {
+	mu    sync.Mutex
+	epoch byte
+	keys  map[byte]rotatingKey
+}
+
+func (p *rotatingKeyProvider) CurrentKey() (byte, []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.epoch, p.keys[p.epoch].key
+}
+
+func (p *rotatingKeyProvider) KeyForEpoch(epoch byte) ([]byte, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	k, ok := p.keys[epoch]
+	if !ok {
+		return nil, false
+	}
+	if !k.expireAt.IsZero() && time.Now().After(k.expireAt) {
+		delete(p.keys, epoch)
+		return nil, false
+	}
+	return k.key, true
+}
+
+func (p *rotatingKeyProvider) Rotate(newKey []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if old, ok := p.keys[p.epoch]; ok {
+		old.expireAt = time.Now().Add(keyEpochGrace)
+		p.keys[p.epoch] = old
+	}
+
+	p.epoch++
+	p.keys[p.epoch] = rotatingKey{key: newKey}
+}
+
+// Encrypted wraps inner so that packet bodies are sealed with an AEAD
+// (ChaCha20Poly1305 by default) before inner frames them, and opened
+// again after inner reads them. It lives inside the framing layer, not
+// at the transport, so keys can be rotated mid-stream without a TLS-style
+// renegotiation.
+func Encrypted(inner Protocol, keys KeyProvider) Protocol {
+	return EncryptedWith(inner, keys, ChaCha20Poly1305)
+}
+
+// EncryptedWith is Encrypted with an explicit AEADAlgo, e.g. AESGCM.
+func EncryptedWith(inner Protocol, keys KeyProvider, algo AEADAlgo) Protocol {
+	return &encryptedProtocol{inner: inner, keys: keys, algo: algo}
+}
+
+type encryptedProtocol struct {
+	inner Protocol
+	keys  KeyProvider
+	algo  AEADAlgo
+}
+
+// Create a packet writer.
+func (p *encryptedProtocol) NewWriter() PacketWriter {
+	w := &encryptedWriter{inner: p.inner.NewWriter(), keys: p.keys, algo: p.algo}
+	rand.Read(w.noncePrefix[:])
+	return w
+}
+
+// Create a packet reader.
+func (p *encryptedProtocol) NewReader() PacketReader {
+	return &encryptedReader{inner: p.inner.NewReader(), keys: p.keys, algo: p.algo}
+}
+
+// The writer side of Encrypted. Every packet gets a fresh nonce built
+// from a per-writer random 4-byte prefix and a monotonic counter, so two
+// writers reuse a nonce under the same key only if their random
+// prefixes happen to collide.
+type encryptedWriter struct {
+	SimpleSettings
+	inner       PacketWriter
+	keys        KeyProvider
+	algo        AEADAlgo
+	noncePrefix [4]byte
+	counter     uint64
+}
+
+func (w *encryptedWriter) BeginPacket(size int, buffer OutBuffer) {
+	w.inner.BeginPacket(size, buffer)
+}
+
+func (w *encryptedWriter) EndPacket(buffer OutBuffer) {
+	plain := buffer.Data
+
+	epoch, key := w.keys.CurrentKey()
+	aead, err := w.algo(key)
+	if err != nil {
+		panic(err)
+	}
+
+	nonce := globalPool.allocData(aead.NonceSize())
+	defer globalPool.putData(nonce)
+	copy(nonce, w.noncePrefix[:])
+	binary.BigEndian.PutUint64(nonce[len(w.noncePrefix):], atomic.AddUint64(&w.counter, 1))
+
+	// Size sealed/out up front from the pool: Seal/append must land in
+	// the buffer we already hold so the defers below release the actual
+	// (possibly reallocated-within-cap) buffers, not the zero-length
+	// stand-ins they started as.
+	sealed := globalPool.allocData(len(plain) + aead.Overhead())[:0]
+	sealed = aead.Seal(sealed, nonce, plain, nil)
+	defer globalPool.putData(sealed)
+
+	out := globalPool.allocData(1 + len(nonce) + len(sealed))[:0]
+	out = append(out, epoch)
+	out = append(out, nonce...)
+	out = append(out, sealed...)
+	defer globalPool.putData(out)
+
+	buffer.Prepare(len(out))
+	buffer.Append(out...)
+
+	w.inner.EndPacket(buffer)
+}
+
+func (w *encryptedWriter) WritePacket(conn net.Conn, buffer OutBuffer) error {
+	return w.inner.WritePacket(conn, buffer)
+}
+
+// The reader side of Encrypted.
+type encryptedReader struct {
+	SimpleSettings
+	inner PacketReader
+	keys  KeyProvider
+	algo  AEADAlgo
+}
+
+func (r *encryptedReader) ReadPacket(conn net.Conn, buffer InBuffer) error {
+	if err := r.inner.ReadPacket(conn, buffer); err != nil {
+		return err
+	}
+	return decodeEncryptedBody(&buffer, buffer.Data, r.keys, r.algo)
+}
+
+// decodeEncryptedBody parses the [epoch][nonce][ciphertext] wire
+// payload in body, opens it, and replaces buffer's contents with the
+// plaintext. It takes buffer by pointer for the same reason
+// decodeBody does in compress.go: Prepare reassigns buffer.Data, and
+// that reassignment needs to stick for the rest of ReadPacket's own
+// call.
+func decodeEncryptedBody(buffer *InBuffer, body []byte, keys KeyProvider, algo AEADAlgo) error {
+	if len(body) == 0 {
+		return nil
+	}
+
+	epoch, body := body[0], body[1:]
+	key, ok := keys.KeyForEpoch(epoch)
+	if !ok {
+		return ErrStaleKeyEpoch
+	}
+
+	aead, err := algo(key)
+	if err != nil {
+		return err
+	}
+
+	nonceSize := aead.NonceSize()
+	if len(body) < nonceSize {
+		return ErrTruncatedCiphertext
+	}
+	nonce, ciphertext := body[:nonceSize], body[nonceSize:]
+
+	plainLen := len(ciphertext) - aead.Overhead()
+	if plainLen < 0 {
+		plainLen = 0
+	}
+	plain := globalPool.allocData(plainLen)[:0]
+	plain, err = aead.Open(plain, nonce, ciphertext, nil)
+	defer globalPool.putData(plain)
+	if err != nil {
+		return err
+	}
+
+	buffer.Prepare(len(plain))
+	copy(buffer.Data, plain)
+	return nil
+}
+
+// Rekeying rotates a connection's outbound encryption key: writes
+// starting now use newKey under a new epoch, while reads keep accepting
+// the previous epoch until its grace window elapses. The application is
+// responsible for getting newKey to the peer out of band (or via an
+// application-level packet) before traffic under it arrives.
+//
+// There's no Session.RekeyOutbound wrapper here: this tree doesn't
+// carry session.go, so there's no Session to hang it off of. Until it
+// does, call Rotate on the KeyProvider passed to Encrypted/EncryptedWith
+// directly.
+//
+// TODO(session.go): the originally requested Session.RekeyOutbound is
+// outstanding, not delivered by this package. Track it rather than
+// treating it as closed.
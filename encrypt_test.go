@@ -0,0 +1,79 @@
+package link
+
+import (
+	"testing"
+)
+
+func encodeEncryptedWire(t *testing.T, keys KeyProvider, algo AEADAlgo, plain []byte) []byte {
+	t.Helper()
+
+	epoch, key := keys.CurrentKey()
+	aead, err := algo(key)
+	if err != nil {
+		t.Fatalf("algo: %v", err)
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	sealed := aead.Seal(nil, nonce, plain, nil)
+
+	wire := append([]byte{epoch}, nonce...)
+	wire = append(wire, sealed...)
+	return wire
+}
+
+func TestDecodeEncryptedBodyRoundTrip(t *testing.T) {
+	for _, algo := range []AEADAlgo{ChaCha20Poly1305, AESGCM} {
+		keys := NewKeyProvider(make([]byte, 32)) // valid key size for both ChaCha20Poly1305 and AES-256-GCM
+		plain := []byte("this is a secret packet body")
+
+		wire := encodeEncryptedWire(t, keys, algo, plain)
+
+		buf := NewInBuffer()
+		if err := decodeEncryptedBody(buf, wire, keys, algo); err != nil {
+			t.Fatalf("decodeEncryptedBody: %v", err)
+		}
+		if string(buf.Data) != string(plain) {
+			t.Fatalf("decodeEncryptedBody = %q, want %q", buf.Data, plain)
+		}
+	}
+}
+
+func TestDecodeEncryptedBodyRejectsStaleEpoch(t *testing.T) {
+	keys := NewKeyProvider(make([]byte, 32))
+	wire := encodeEncryptedWire(t, keys, ChaCha20Poly1305, []byte("hi"))
+	wire[0] = 0xFF // no such epoch
+
+	buf := NewInBuffer()
+	if err := decodeEncryptedBody(buf, wire, keys, ChaCha20Poly1305); err != ErrStaleKeyEpoch {
+		t.Fatalf("decodeEncryptedBody with bad epoch = %v, want ErrStaleKeyEpoch", err)
+	}
+}
+
+// A packet too short to even hold a full nonce must return an error,
+// not slice out of range.
+func TestDecodeEncryptedBodyRejectsTruncatedCiphertext(t *testing.T) {
+	keys := NewKeyProvider(make([]byte, 32))
+	buf := NewInBuffer()
+
+	for _, wire := range [][]byte{
+		{0x00},
+		{0x00, 0x01, 0x02, 0x03},
+	} {
+		if err := decodeEncryptedBody(buf, wire, keys, ChaCha20Poly1305); err != ErrTruncatedCiphertext {
+			t.Fatalf("decodeEncryptedBody(%v) = %v, want ErrTruncatedCiphertext", wire, err)
+		}
+	}
+}
+
+func TestDecodeEncryptedBodyEmptyIsNoop(t *testing.T) {
+	keys := NewKeyProvider(make([]byte, 32))
+	buf := NewInBuffer()
+	buf.Data = []byte("untouched")
+
+	if err := decodeEncryptedBody(buf, nil, keys, ChaCha20Poly1305); err != nil {
+		t.Fatalf("decodeEncryptedBody: %v", err)
+	}
+	if string(buf.Data) != "untouched" {
+		t.Fatalf("decodeEncryptedBody(nil) mutated buffer to %q", buf.Data)
+	}
+}
@@ -0,0 +1,71 @@
+package link
+
+import (
+	"errors"
+	"net"
+)
+
+// Protocol builds the packet writer/reader pair a connection uses to
+// frame its wire format. PacketN, Compressed, and Encrypted all
+// implement it, so they can be layered on top of each other freely.
+type Protocol interface {
+	// Create a packet writer.
+	NewWriter() PacketWriter
+
+	// Create a packet reader.
+	NewReader() PacketReader
+}
+
+// PacketWriter turns an OutBuffer's payload into a framed packet on the
+// wire. BeginPacket reserves room for the frame's own header before the
+// caller fills in the payload; EndPacket fills that header in once the
+// payload's final size is known; WritePacket flushes the framed buffer
+// to conn.
+//
+// TODO: every method here takes its buffer by value, so a reassignment
+// to buffer.Data inside the call (which BeginPacket/EndPacket do, to
+// make room for a header, compress, or encrypt) never reaches the
+// caller's own variable - only a pool-internal *InBuffer/*OutBuffer
+// threaded through all three calls by the same owner actually works.
+// compress.go, encrypt.go, and packetn.go are all written against this
+// contract already, so fixing it means changing every implementation's
+// signature at once; predates this series and is tracked here rather
+// than carried silently.
+type PacketWriter interface {
+	// Begin a packet writing on the buffer, reserving room for the
+	// frame's header ahead of size bytes of payload.
+	BeginPacket(size int, buffer OutBuffer)
+
+	// Finish a packet writing, filling in any header fields (e.g. a
+	// length prefix) that depend on the payload's final size.
+	EndPacket(buffer OutBuffer)
+
+	// Write a packet to the conn.
+	WritePacket(conn net.Conn, buffer OutBuffer) error
+}
+
+// PacketReader reads one framed packet from conn into buffer.
+type PacketReader interface {
+	// Read a packet from conn.
+	ReadPacket(conn net.Conn, buffer InBuffer) error
+}
+
+// PacketTooLargeError is returned by a PacketReader when a packet's
+// declared size exceeds its SimpleSettings.maxsize.
+var PacketTooLargeError = errors.New("link: packet too large")
+
+// SimpleSettings is the embeddable per-writer/per-reader settings every
+// Protocol implementation in this package carries: a max packet size,
+// with 0 meaning "no limit".
+type SimpleSettings struct {
+	maxsize int
+}
+
+// SetMaxSize sets the max packet size and returns the previous value.
+// Unlike PoolMaxDataSize, a size of 0 is not a query: it sets the
+// limit to 0, meaning "no limit".
+func (s *SimpleSettings) SetMaxSize(size int) int {
+	old := s.maxsize
+	s.maxsize = size
+	return old
+}